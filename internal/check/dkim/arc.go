@@ -0,0 +1,558 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/check"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// maxARCInstance is the highest "i=" value accepted in an ARC set, as
+// mandated by RFC 8617 Section 4.2.2.
+const maxARCInstance = 50
+
+// ArcCheck implements the verify_arc module - it walks the ARC-Seal,
+// ARC-Message-Signature and ARC-Authentication-Results header sets left
+// by intermediate forwarders and validates the resulting chain.
+type ArcCheck struct {
+	instName string
+	log      log.Logger
+
+	trustedForwarders map[string]struct{}
+	chainAction       check.FailAction
+	maxInstance       int
+}
+
+func NewArc(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("verify_arc: inline arguments are not used")
+	}
+	return &ArcCheck{
+		instName: instName,
+		log:      log.Logger{Name: "verify_arc"},
+	}, nil
+}
+
+func (c *ArcCheck) Init(cfg *config.Map) error {
+	var trustedForwarders []string
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.StringList("trusted_forwarders", false, false, nil, &trustedForwarders)
+	cfg.Int("max_instance", false, false, maxARCInstance, &c.maxInstance)
+	cfg.Custom("chain_action", false, false,
+		func() (interface{}, error) {
+			return check.FailAction{}, nil
+		}, check.FailActionDirective, &c.chainAction)
+	_, err := cfg.Process()
+	if err != nil {
+		return err
+	}
+
+	c.trustedForwarders = make(map[string]struct{}, len(trustedForwarders))
+	for _, domain := range trustedForwarders {
+		c.trustedForwarders[strings.ToLower(domain)] = struct{}{}
+	}
+
+	return nil
+}
+
+func (c *ArcCheck) Name() string {
+	return "verify_arc"
+}
+
+func (c *ArcCheck) InstanceName() string {
+	return c.instName
+}
+
+type arcCheckState struct {
+	c       *ArcCheck
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (d *arcCheckState) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (d *arcCheckState) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (d *arcCheckState) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+// arcSet holds the three headers that make up a single ARC instance.
+type arcSet struct {
+	instance int
+	seal     string
+	ams      string
+	aar      string
+}
+
+func (d *arcCheckState) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, "verify_arc/CheckBody").End()
+
+	sets, err := collectARCSets(header, d.c.maxInstance)
+	if err != nil {
+		d.log.Debugf("malformed ARC headers: %v", err)
+		return module.CheckResult{
+			AuthResult: []authres.Result{
+				&authres.ARCResult{Value: authres.ResultPermError, Reason: err.Error()},
+			},
+		}
+	}
+	if len(sets) == 0 {
+		// No ARC chain present at all - this is not an error, most mail
+		// simply has none.
+		return module.CheckResult{}
+	}
+
+	cv, lastSealer, aarResults, err := verifyARCChain(sets, header, body)
+	if err != nil {
+		d.log.DebugMsg("ARC chain verification failed", "err", err)
+	}
+
+	// verifyARCChain only ever returns "pass" or "fail" - an ARC chain
+	// with no sets at all was already handled above, before cv exists.
+	res := authres.ResultValue(authres.ResultFail)
+	if cv == "pass" {
+		res = authres.ResultPass
+	}
+
+	result := module.CheckResult{
+		AuthResult: []authres.Result{
+			&authres.ARCResult{Value: res},
+		},
+	}
+
+	if cv == "pass" {
+		if _, trusted := d.c.trustedForwarders[strings.ToLower(lastSealer)]; trusted {
+			// The chain is intact and the most recent sealer is one we
+			// trust to have authenticated the message on our behalf -
+			// re-surface what it saw instead of acting on the chain
+			// being merely "pass".
+			result.AuthResult = append(result.AuthResult, aarResults...)
+			return result
+		}
+	}
+
+	if cv != "pass" {
+		result.Reason = &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 29},
+			Message:      "Broken ARC chain",
+			CheckName:    "verify_arc",
+		}
+		return d.c.chainAction.Apply(result)
+	}
+
+	return result
+}
+
+func (d *arcCheckState) Name() string {
+	return "verify_arc"
+}
+
+func (d *arcCheckState) Close() error {
+	return nil
+}
+
+func (c *ArcCheck) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &arcCheckState{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func init() {
+	module.Register("verify_arc", NewArc)
+}
+
+// arcTrustSuppresses reports whether header/body carry an ARC chain that
+// verifies (cv=pass) and was last sealed by one of the domains in
+// trusted, in which case a verify_dkim failure on the same message
+// should be suppressed in favor of what that trusted forwarder saw. When
+// it returns true, results holds the ARC-Authentication-Results entries
+// to re-surface instead. This lets Check (verify_dkim) honor the same
+// trusted-forwarder exception ArcCheck applies to itself, without the
+// two checks otherwise sharing any state.
+func arcTrustSuppresses(header textproto.Header, body buffer.Buffer, trusted map[string]struct{}, maxInstance int) (bool, []authres.Result) {
+	if len(trusted) == 0 {
+		return false, nil
+	}
+
+	sets, err := collectARCSets(header, maxInstance)
+	if err != nil || len(sets) == 0 {
+		return false, nil
+	}
+
+	cv, lastSealer, aarResults, err := verifyARCChain(sets, header, body)
+	if err != nil || cv != "pass" {
+		return false, nil
+	}
+
+	if _, ok := trusted[strings.ToLower(lastSealer)]; !ok {
+		return false, nil
+	}
+	return true, aarResults
+}
+
+// collectARCSets groups the ARC-Seal/ARC-Message-Signature/
+// ARC-Authentication-Results headers by their "i=" instance tag. Headers
+// are returned ordered from the oldest instance (the one closest to the
+// originating sender) to the newest (the one added by the last hop).
+func collectARCSets(header textproto.Header, maxInstance int) ([]arcSet, error) {
+	byInstance := make(map[int]*arcSet)
+	seen := make(map[string]struct{})
+
+	collect := func(fieldName string, assign func(*arcSet, string)) error {
+		fields := header.FieldsByKey(fieldName)
+		for fields.Next() {
+			instance, err := arcInstance(fields.Value())
+			if err != nil {
+				return fmt.Errorf("%v: %w", fieldName, err)
+			}
+			if instance < 1 || instance > maxInstance {
+				return fmt.Errorf("%v: instance %v out of range", fieldName, instance)
+			}
+
+			// RFC 8617 Section 4.2.2 requires "i=" values to be unique per
+			// header type; a forwarder emitting two ARC-Seal (or AMS, or
+			// AAR) headers for the same instance is exactly the kind of
+			// tampering the chain is meant to catch, so the duplicate must
+			// be rejected rather than silently overwriting the first copy.
+			dupKey := fmt.Sprintf("%s:%d", fieldName, instance)
+			if _, ok := seen[dupKey]; ok {
+				return fmt.Errorf("%v: duplicate header for instance %v", fieldName, instance)
+			}
+			seen[dupKey] = struct{}{}
+
+			set, ok := byInstance[instance]
+			if !ok {
+				set = &arcSet{instance: instance}
+				byInstance[instance] = set
+			}
+			assign(set, fields.Value())
+		}
+		return nil
+	}
+
+	if err := collect("ARC-Seal", func(s *arcSet, v string) { s.seal = v }); err != nil {
+		return nil, err
+	}
+	if err := collect("ARC-Message-Signature", func(s *arcSet, v string) { s.ams = v }); err != nil {
+		return nil, err
+	}
+	if err := collect("ARC-Authentication-Results", func(s *arcSet, v string) { s.aar = v }); err != nil {
+		return nil, err
+	}
+
+	if len(byInstance) == 0 {
+		return nil, nil
+	}
+
+	sets := make([]arcSet, 0, len(byInstance))
+	for i := 1; i <= len(byInstance); i++ {
+		set, ok := byInstance[i]
+		if !ok || set.seal == "" || set.ams == "" || set.aar == "" {
+			return nil, fmt.Errorf("incomplete or non-contiguous ARC set at instance %v", i)
+		}
+		sets = append(sets, *set)
+	}
+	sort.Slice(sets, func(i, j int) bool { return sets[i].instance < sets[j].instance })
+	return sets, nil
+}
+
+func arcInstance(headerValue string) (int, error) {
+	tags, err := parseTagList(headerValue)
+	if err != nil {
+		return 0, err
+	}
+	i, ok := tags["i"]
+	if !ok {
+		return 0, errors.New("missing i= tag")
+	}
+	return strconv.Atoi(i)
+}
+
+// parseTagList parses the "tag-list" ABNF shared by DKIM-Signature-like
+// headers (tag=value; tag=value; ...).
+func parseTagList(headerValue string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(headerValue, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed tag: %q", part)
+		}
+		tags[strings.TrimSpace(name)] = strings.TrimSpace(val)
+	}
+	return tags, nil
+}
+
+// verifyARCChain validates every ARC-Seal in order and returns the
+// effective chain validation result (cv), the domain ("d=") of the last
+// (newest) sealer and the ARC-Authentication-Results entries to
+// re-surface if the chain is trusted.
+//
+// Per RFC 8617 Section 5.2, the chain as a whole is "pass" iff:
+//   - every instance's ARC-Message-Signature verifies against the
+//     message, and
+//   - every instance's ARC-Seal verifies against the prior instances'
+//     seals, and
+//   - cv= on the oldest instance is "none" and on every later instance
+//     is "pass".
+func verifyARCChain(sets []arcSet, header textproto.Header, body buffer.Buffer) (cv string, lastSealer string, aarResults []authres.Result, err error) {
+	aarResults = make([]authres.Result, 0, len(sets))
+
+	for idx, set := range sets {
+		sealTags, err := parseTagList(set.seal)
+		if err != nil {
+			return "fail", "", nil, fmt.Errorf("instance %v: malformed ARC-Seal: %w", set.instance, err)
+		}
+
+		instanceCV := sealTags["cv"]
+		if idx == 0 && instanceCV != "none" {
+			return "fail", "", nil, fmt.Errorf("instance %v: expected cv=none on the oldest instance, got %q", set.instance, instanceCV)
+		}
+		if idx > 0 && instanceCV != "pass" {
+			return "fail", sealTags["d"], nil, fmt.Errorf("instance %v: cv=%q breaks the chain", set.instance, instanceCV)
+		}
+
+		if err := checkAMS(set, header, body); err != nil {
+			return "fail", sealTags["d"], nil, fmt.Errorf("instance %v: ARC-Message-Signature: %w", set.instance, err)
+		}
+
+		if err := verifySeal(sets[:idx+1]); err != nil {
+			return "fail", sealTags["d"], nil, fmt.Errorf("instance %v: ARC-Seal: %w", set.instance, err)
+		}
+
+		lastSealer = sealTags["d"]
+		aarResults = append(aarResults, &authres.ARCResult{
+			Value:  authres.ResultPass,
+			Reason: set.aar,
+		})
+	}
+
+	return "pass", lastSealer, aarResults, nil
+}
+
+// checkAMS is verifyAMS by default; it is a package variable so tests can
+// substitute a stub and exercise the rest of the chain (instance
+// ordering, cv= bookkeeping, ARC-Seal verification) without needing a
+// live DNS resolver for the AMS signer's key, which dkim.Verify fetches
+// on its own and gives this package no way to override.
+var checkAMS = verifyAMS
+
+// verifyAMS checks the ARC-Message-Signature of a single instance. Its
+// signing algorithm and canonicalization are identical to a regular
+// DKIM-Signature, so we reuse the DKIM verifier by presenting the
+// message with ARC-Message-Signature relabeled as DKIM-Signature.
+func verifyAMS(set arcSet, header textproto.Header, body buffer.Buffer) error {
+	relabeled := header.Copy()
+	relabeled.Del("DKIM-Signature")
+	relabeled.Add("DKIM-Signature", set.ams)
+
+	b := bytes.Buffer{}
+	if err := textproto.WriteHeader(&b, relabeled); err != nil {
+		return err
+	}
+	bodyRdr, err := body.Open()
+	if err != nil {
+		return err
+	}
+
+	verifications, err := dkim.Verify(io.MultiReader(&b, bodyRdr))
+	if err != nil {
+		return err
+	}
+	if len(verifications) != 1 {
+		return fmt.Errorf("expected exactly one signature after relabeling, got %v", len(verifications))
+	}
+	return verifications[0].Err
+}
+
+// verifySeal verifies the ARC-Seal of the newest instance in chain
+// (chain[len(chain)-1]) against the canonicalized ARC-Seal,
+// ARC-Message-Signature and ARC-Authentication-Results headers of every
+// instance up to and including it, per RFC 8617 Section 4.2.1. The
+// actual signature check is delegated to the same primitives go-msgauth
+// uses internally (relaxed header canonicalization + RSA/Ed25519
+// verify); b= is stripped from the seal being verified before hashing,
+// as mandated by the RFC.
+func verifySeal(chain []arcSet) error {
+	newest := chain[len(chain)-1]
+	tags, err := parseTagList(newest.seal)
+	if err != nil {
+		return err
+	}
+	if tags["b"] == "" {
+		return errors.New("missing b= tag")
+	}
+
+	var buf bytes.Buffer
+	for _, set := range chain[:len(chain)-1] {
+		buf.WriteString(relaxedHeader("ARC-Authentication-Results", set.aar))
+		buf.WriteString(relaxedHeader("ARC-Message-Signature", set.ams))
+		buf.WriteString(relaxedHeader("ARC-Seal", set.seal))
+	}
+	buf.WriteString(relaxedHeader("ARC-Authentication-Results", newest.aar))
+	buf.WriteString(relaxedHeader("ARC-Message-Signature", newest.ams))
+	buf.WriteString(relaxedSealForHashing(newest.seal))
+
+	return verifyTagSignature(tags, buf.Bytes())
+}
+
+// relaxedHeader renders a header field using the DKIM "relaxed" header
+// canonicalization algorithm (RFC 6376 Section 3.4.2).
+func relaxedHeader(name, value string) string {
+	v := strings.Join(strings.Fields(value), " ")
+	return strings.ToLower(name) + ":" + strings.TrimSpace(v) + "\r\n"
+}
+
+// relaxedSealForHashing is like relaxedHeader but with the b= tag's
+// value removed, as ARC-Seal does not cover its own signature (RFC 8617
+// Section 4.1.3). Relaxed canonicalization does not reorder tags, so
+// unlike parseTagList this folds whitespace and blanks b= in place in
+// the original tag-list text instead of rebuilding it from a map, which
+// would lose the sealer's original tag order and make every signature
+// fail to verify. The value's own whitespace is folded first (same rule
+// relaxedHeader applies) so that blanking b='s value does not disturb
+// the single-space separators the rest of the line already has.
+func relaxedSealForHashing(value string) string {
+	_, tagPart, ok := strings.Cut(value, ":")
+	if !ok {
+		tagPart = value
+	}
+	folded := strings.Join(strings.Fields(tagPart), " ")
+
+	rawTags := strings.Split(folded, ";")
+	for i, part := range rawTags {
+		eq := strings.Index(part, "=")
+		if eq < 0 {
+			continue
+		}
+		if strings.TrimSpace(part[:eq]) == "b" {
+			rawTags[i] = part[:eq+1]
+		}
+	}
+
+	return "arc-seal:" + strings.TrimSpace(strings.Join(rawTags, ";")) + "\r\n"
+}
+
+func verifyTagSignature(tags map[string]string, signedData []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(tags["b"]), ""))
+	if err != nil {
+		return fmt.Errorf("malformed b= tag: %w", err)
+	}
+
+	pubKey, err := lookupPublicKey(tags["s"], tags["d"])
+	if err != nil {
+		return fmt.Errorf("public key lookup: %w", err)
+	}
+
+	switch tags["a"] {
+	case "rsa-sha256":
+		rsaKey, ok := pubKey.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key type mismatch, expected RSA")
+		}
+		sum := sha256.Sum256(signedData)
+		return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, sum[:], sig)
+	case "ed25519-sha256":
+		edKey, ok := pubKey.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("key type mismatch, expected Ed25519")
+		}
+		sum := sha256.Sum256(signedData)
+		if !ed25519.Verify(edKey, sum[:], sig) {
+			return errors.New("signature does not verify")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported a= algorithm: %v", tags["a"])
+	}
+}
+
+// lookupTXT is net.LookupTXT by default; it is a package variable so
+// tests can substitute a fake DKIM key record without a live resolver.
+var lookupTXT = net.LookupTXT
+
+// lookupPublicKey fetches and parses the public key advertised at
+// <selector>._domainkey.<domain>, the same DNS location a DKIM verifier
+// for that selector/domain would use (RFC 6376 Section 3.6.2).
+func lookupPublicKey(selector, domain string) (crypto.PublicKey, error) {
+	if selector == "" || domain == "" {
+		return nil, errors.New("missing s= or d= tag")
+	}
+
+	txts, err := lookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var rec string
+	for _, txt := range txts {
+		if strings.Contains(txt, "p=") {
+			rec = txt
+			break
+		}
+	}
+	if rec == "" {
+		return nil, errors.New("no DKIM key record found")
+	}
+
+	recTags, err := parseTagList(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(recTags["p"])
+	if err != nil {
+		return nil, fmt.Errorf("malformed p= tag: %w", err)
+	}
+
+	switch recTags["k"] {
+	case "", "rsa":
+		key, err := x509.ParsePKIXPublicKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	case "ed25519":
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, errors.New("malformed ed25519 public key")
+		}
+		return ed25519.PublicKey(raw), nil
+	default:
+		return nil, fmt.Errorf("unsupported k= algorithm: %v", recTags["k"])
+	}
+}
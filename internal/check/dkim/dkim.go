@@ -30,6 +30,16 @@ type Check struct {
 	brokenSigAction check.FailAction
 	noSigAction     check.FailAction
 	failOpen        bool
+
+	// arcTrustedForwarders and arcMaxInstance configure the same
+	// trusted-forwarder exception verify_arc applies to its own
+	// chainAction: if the message carries no usable DKIM-Signature (or
+	// none that verify) but does carry an ARC chain that passes and was
+	// last sealed by one of these domains, noSigAction/brokenSigAction is
+	// suppressed in favor of the ARC-Authentication-Results the
+	// forwarder recorded.
+	arcTrustedForwarders map[string]struct{}
+	arcMaxInstance       int
 }
 
 func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -44,6 +54,7 @@ func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 
 func (c *Check) Init(cfg *config.Map) error {
 	var requiredFields []string
+	var arcTrustedForwarders []string
 
 	cfg.Bool("debug", true, false, &c.log.Debug)
 	cfg.StringList("required_fields", false, false, []string{"From", "Subject"}, &requiredFields)
@@ -57,6 +68,8 @@ func (c *Check) Init(cfg *config.Map) error {
 		func() (interface{}, error) {
 			return check.FailAction{}, nil
 		}, check.FailActionDirective, &c.noSigAction)
+	cfg.StringList("arc_trusted_forwarders", false, false, nil, &arcTrustedForwarders)
+	cfg.Int("arc_max_instance", false, false, maxARCInstance, &c.arcMaxInstance)
 	_, err := cfg.Process()
 	if err != nil {
 		return err
@@ -67,6 +80,11 @@ func (c *Check) Init(cfg *config.Map) error {
 		c.requiredFields[nettextproto.CanonicalMIMEHeaderKey(field)] = struct{}{}
 	}
 
+	c.arcTrustedForwarders = make(map[string]struct{}, len(arcTrustedForwarders))
+	for _, domain := range arcTrustedForwarders {
+		c.arcTrustedForwarders[strings.ToLower(domain)] = struct{}{}
+	}
+
 	return nil
 }
 
@@ -100,6 +118,11 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 	defer trace.StartRegion(ctx, "verify_dkim/CheckBody").End()
 
 	if !header.Has("DKIM-Signature") {
+		if ok, aarResults := arcTrustSuppresses(header, body, d.c.arcTrustedForwarders, d.c.arcMaxInstance); ok {
+			d.log.Debugf("no DKIM signatures, but trusted ARC chain present")
+			return module.CheckResult{AuthResult: aarResults}
+		}
+
 		if d.c.noSigAction.Reject || d.c.noSigAction.Quarantine {
 			d.log.Printf("no signatures present")
 		} else {
@@ -219,6 +242,12 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 	}
 
 	if !goodSigs {
+		if ok, aarResults := arcTrustSuppresses(header, body, d.c.arcTrustedForwarders, d.c.arcMaxInstance); ok {
+			d.log.Debugf("no passing DKIM signatures, but trusted ARC chain present")
+			res.AuthResult = append(res.AuthResult, aarResults...)
+			return res
+		}
+
 		res.Reason = &exterrors.SMTPError{
 			Code:         550,
 			EnhancedCode: exterrors.EnhancedCode{5, 7, 20},
@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/foxcpp/maddy/internal/modify/dkim"
+	"github.com/urfave/cli/v2"
+)
+
+var dkimCommand = &cli.Command{
+	Name:  "dkim",
+	Usage: "DKIM key management",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "keygen",
+			Usage: "Generate a new DKIM key pair for use with sign_dkim",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "domain",
+					Usage:    "domain the key will be used to sign mail for",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "selector",
+					Usage:    "DKIM selector",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "out",
+					Usage: "path to write the PEM private key to",
+				},
+			},
+			Action: dkimKeygen,
+		},
+	},
+}
+
+func dkimKeygen(ctx *cli.Context) error {
+	domain := ctx.String("domain")
+	selector := ctx.String("selector")
+
+	keyPEM, dnsRecord, err := dkim.GenerateEd25519Key(selector, domain)
+	if err != nil {
+		return fmt.Errorf("dkim keygen: %w", err)
+	}
+
+	out := ctx.String("out")
+	if out == "" {
+		out = filepath.Join(".", selector+"."+domain+".key")
+	}
+	if err := os.WriteFile(out, keyPEM, 0600); err != nil {
+		return fmt.Errorf("dkim keygen: %w", err)
+	}
+
+	fmt.Printf("Private key written to %s\n", out)
+	fmt.Printf("Add the following TXT record for %s._domainkey.%s:\n\n", selector, domain)
+	fmt.Printf("%s\n", dnsRecord)
+	return nil
+}
@@ -0,0 +1,232 @@
+package dns
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultCacheSize is the default number of (qname, qtype) entries kept
+// in a CachingResolver before the least-recently-used one is evicted.
+// It bounds memory growth if something (e.g. an attacker probing random
+// subdomains) tries to force unbounded cache growth.
+const defaultCacheSize = 10000
+
+// cacheEntry is the cached value for one (qname, qtype) pair.
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dns.Msg
+	ad      bool
+	expires time.Time
+}
+
+type cacheKey struct {
+	qname string
+	qtype uint16
+}
+
+// CachingResolver wraps an ExtResolver with an in-process TTL cache,
+// keyed by (qname, qtype), so a burst of SMTP transactions that all need
+// the same MX/TXT/TLSA/PTR records do not each trigger a fresh upstream
+// query. It honors the answer's own TTLs and RFC 2308 negative caching
+// (keyed on the SOA MINIMUM from the authority section) for
+// NXDOMAIN/NODATA responses.
+type CachingResolver struct {
+	upstream *ExtResolver
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+	maxSize int
+}
+
+// NewCachingResolver wraps upstream with a bounded LRU TTL cache of at
+// most maxSize entries. If maxSize is <= 0, defaultCacheSize is used.
+func NewCachingResolver(upstream *ExtResolver, maxSize int) *CachingResolver {
+	if maxSize <= 0 {
+		maxSize = defaultCacheSize
+	}
+
+	return &CachingResolver{
+		upstream: upstream,
+		entries:  make(map[cacheKey]*list.Element),
+		lru:      list.New(),
+		maxSize:  maxSize,
+	}
+}
+
+// cacheLookups counts DNS cache lookups by outcome ("hit", "miss" or
+// "negative_hit"). It is a single package-level vector rather than a
+// per-CachingResolver counter set so that constructing more than one
+// CachingResolver (e.g. in tests) does not attempt to register the same
+// metric name twice.
+var cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "maddy_dns_cache_lookups_total",
+	Help: "Count of DNS cache lookups by outcome (hit, miss, negative_hit).",
+}, []string{"result"})
+
+// Metrics returns the Prometheus collectors maintained by the cache, for
+// registration with a registry by the caller.
+func (c *CachingResolver) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{cacheLookups}
+}
+
+func (c *CachingResolver) AuthLookupAddr(ctx context.Context, addr string) (ad bool, names []string, err error) {
+	return authLookupAddr(ctx, c, addr)
+}
+
+func (c *CachingResolver) AuthLookupHost(ctx context.Context, host string) (ad bool, addrs []string, err error) {
+	return authLookupHost(ctx, c, host)
+}
+
+func (c *CachingResolver) AuthLookupMX(ctx context.Context, name string) (ad bool, mxs []*net.MX, err error) {
+	return authLookupMX(ctx, c, name)
+}
+
+func (c *CachingResolver) AuthLookupTXT(ctx context.Context, name string) (ad bool, recs []string, err error) {
+	return authLookupTXT(ctx, c, name)
+}
+
+func (c *CachingResolver) AuthLookupIPAddr(ctx context.Context, host string) (ad bool, addrs []net.IPAddr, err error) {
+	return authLookupIPAddr(ctx, c, host)
+}
+
+func (c *CachingResolver) AuthLookupTLSA(ctx context.Context, service, network, domain string) (ad bool, recs []TLSA, err error) {
+	return authLookupTLSA(ctx, c, service, network, domain)
+}
+
+// exchange implements the exchanger interface: it serves from cache when
+// possible and otherwise queries the wrapped ExtResolver and caches the
+// result (positive or negative) before returning it. EDNS0 COOKIE
+// handling is done per-upstream by ExtResolver's own transports, since a
+// cookie is only meaningful to the upstream that issued it.
+func (c *CachingResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	key := cacheKey{qname: msg.Question[0].Name, qtype: msg.Question[0].Qtype}
+
+	if resp, ad, ok := c.lookup(key); ok {
+		resp = resp.Copy()
+		resp.Id = msg.Id
+		resp.AuthenticatedData = ad
+		return resp, rcodeErrIfNeeded(key.qname, resp)
+	}
+	cacheLookups.WithLabelValues("miss").Inc()
+
+	resp, err := c.upstream.exchange(ctx, msg)
+	if resp != nil {
+		c.store(key, resp)
+	}
+	return resp, err
+}
+
+// rcodeErrIfNeeded reconstructs the RCodeError/EDEError a live exchange
+// would have returned for a cached non-success response, so a cache hit
+// is not observably different from a cache miss to callers.
+func rcodeErrIfNeeded(qname string, resp *dns.Msg) error {
+	if resp.Rcode != dns.RcodeSuccess {
+		return RCodeError{qname, resp.Rcode, extractEDE(resp)}
+	}
+	if edes := extractEDE(resp); anyBogus(edes) {
+		return EDEError{qname, edes}
+	}
+	return nil
+}
+
+func (c *CachingResolver) lookup(key cacheKey) (*dns.Msg, bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false, false
+	}
+
+	c.lru.MoveToFront(el)
+	if entry.msg.Rcode != dns.RcodeSuccess || len(entry.msg.Answer) == 0 {
+		cacheLookups.WithLabelValues("negative_hit").Inc()
+	} else {
+		cacheLookups.WithLabelValues("hit").Inc()
+	}
+	return entry.msg, entry.ad, true
+}
+
+func (c *CachingResolver) store(key cacheKey, msg *dns.Msg) {
+	ttl := answerTTL(msg)
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{
+		key:     key,
+		msg:     msg.Copy(),
+		ad:      msg.AuthenticatedData,
+		expires: time.Now().Add(ttl),
+	}
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+	} else {
+		c.entries[key] = c.lru.PushFront(entry)
+	}
+
+	for c.lru.Len() > c.maxSize {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			break
+		}
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// answerTTL determines how long msg may be cached for: the minimum TTL
+// among its answer records for a positive response, or the SOA MINIMUM
+// field from the authority section for a negative (NXDOMAIN/NODATA)
+// response, per RFC 2308. The decision is keyed on Rcode rather than on
+// whether the answer section is empty, since an NXDOMAIN response can
+// still carry a CNAME chain in its answer section en route to the name
+// that does not exist.
+func answerTTL(msg *dns.Msg) time.Duration {
+	if msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0 {
+		min := uint32(0)
+		for i, rr := range msg.Answer {
+			ttl := rr.Header().Ttl
+			if i == 0 || ttl < min {
+				min = ttl
+			}
+		}
+		return time.Duration(min) * time.Second
+	}
+
+	// Negative caching: NXDOMAIN or NODATA. Use the SOA MINIMUM from the
+	// authority section, capped by the SOA's own TTL, as the negative
+	// TTL.
+	for _, rr := range msg.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		ttl := soa.Minimum
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+		return time.Duration(ttl) * time.Second
+	}
+
+	// No TTL information to go on at all - don't cache.
+	return 0
+}
@@ -0,0 +1,252 @@
+package dns
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// DANERequired reports whether recs contains at least one TLSA record
+// that can actually be acted on. Per RFC 7672 Section 3.1.1, TLSA
+// records are only usable when they were returned with the AD bit set;
+// an AD=0 answer MUST be treated as if no TLSA records exist at all,
+// meaning DANE is simply not in effect for that MX host - not that its
+// absence is itself suspicious.
+//
+// When DANERequired returns true, the caller MUST NOT let the
+// connection fall back to either an unauthenticated or a plaintext
+// delivery path: RFC 7672 forbids downgrading once a usable TLSA record
+// set is known, even if the peer stops offering STARTTLS.
+func DANERequired(ad bool, recs []TLSA) bool {
+	if !ad {
+		return false
+	}
+	for _, rec := range recs {
+		if _, ok := usageParams[rec.Usage]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// usageParams lists the certificate usages VerifyDANE knows how to act
+// on. Usages 0 (PKIX-TA) and 1 (PKIX-EE) rely on ordinary WebPKI
+// validation rather than a DNSSEC-rooted trust anchor and are not
+// implemented here.
+var usageParams = map[uint8]struct{}{
+	2: {}, // DANE-TA
+	3: {}, // DANE-EE
+}
+
+// VerifyDANE checks state, the TLS connection state established while
+// connecting to a mail exchanger, against recs, the (already AD=1
+// filtered) TLSA record set for that exchanger's "_25._tcp.<mx>" name,
+// per RFC 7672.
+//
+// ad must be the AD flag as returned alongside recs by
+// ExtResolver.AuthLookupTLSA; if it is false, recs MUST be treated as
+// absent by the caller (see DANERequired) and VerifyDANE must not be
+// called.
+//
+// VerifyDANE returns nil as soon as any usable record matches; it
+// returns an error describing the last mismatch if every usable record
+// was tried and none matched. Certificate usage 1 (PKIX-EE) is ignored,
+// since it does not change trust anchor discovery versus normal WebPKI
+// validation and gains nothing beyond what STARTTLS + AuthLookupMX
+// already provides.
+func VerifyDANE(state tls.ConnectionState, ad bool, recs []TLSA) error {
+	if !ad {
+		return fmt.Errorf("dane: TLSA records are unauthenticated (AD=0), refusing to use them")
+	}
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("dane: no peer certificates presented")
+	}
+
+	var lastErr error
+	for _, rec := range recs {
+		var err error
+		switch rec.Usage {
+		case 2:
+			err = verifyDANE_TA(state, rec)
+		case 3:
+			err = verifyDANE_EE(state, rec)
+		default:
+			continue
+		}
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		return fmt.Errorf("dane: no usable TLSA records (only unsupported certificate usages present)")
+	}
+	return fmt.Errorf("dane: no TLSA record matched: %w", lastErr)
+}
+
+// verifyDANE_EE implements certificate usage 3 (DANE-EE): the TLSA
+// record must match the leaf certificate directly; no chain
+// construction or name checks are performed (RFC 7672 Section 3.2,
+// "DANE-EE(3)").
+func verifyDANE_EE(state tls.ConnectionState, rec TLSA) error {
+	leaf := state.PeerCertificates[0]
+	if err := matchCert(leaf, rec); err != nil {
+		return err
+	}
+	return checkChainValidity(state.PeerCertificates[:1])
+}
+
+// verifyDANE_TA implements certificate usage 2 (DANE-TA): some
+// certificate in the chain offered by the peer must match the TLSA
+// record, and that certificate must be a valid issuer for the leaf
+// certificate (a trust anchor assertion, not full WebPKI validation -
+// the TLSA record itself is the trust anchor).
+func verifyDANE_TA(state tls.ConnectionState, rec TLSA) error {
+	for i, cert := range state.PeerCertificates {
+		if err := matchCert(cert, rec); err != nil {
+			continue
+		}
+
+		// A selector/matching-type match on usage 2 additionally
+		// requires that this certificate actually issued (directly or
+		// transitively) the leaf certificate presented in the
+		// handshake.
+		if i == 0 {
+			// The leaf matching its own DANE-TA record is only
+			// meaningful if some other peer-supplied certificate chains
+			// up to it; treat the leaf itself as a trust anchor only
+			// when it is also its own issuer (self-signed MX cert).
+			if !certIsIssuerOf(cert, cert) {
+				continue
+			}
+		} else if !chainsToIssuer(state.PeerCertificates[:i], cert) {
+			continue
+		}
+
+		if err := checkChainValidity(state.PeerCertificates[:i+1]); err != nil {
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("dane: no certificate in the chain matches the DANE-TA record and issues the leaf")
+}
+
+// checkChainValidity requires every certificate in chain to currently
+// fall within its NotBefore/NotAfter window. DANE mode substitutes the
+// TLSA record for ordinary WebPKI path validation, which is the only
+// place expiry is normally checked; CheckSignatureFrom (used by
+// chainsToIssuer/certIsIssuerOf) verifies the signature and basic
+// constraints but never dates, so this is the only remaining place an
+// expired or not-yet-valid certificate gets rejected under DANE.
+func checkChainValidity(chain []*x509.Certificate) error {
+	now := time.Now()
+	for _, cert := range chain {
+		if now.Before(cert.NotBefore) {
+			return fmt.Errorf("dane: certificate %s is not yet valid (NotBefore %s)", cert.Subject, cert.NotBefore)
+		}
+		if now.After(cert.NotAfter) {
+			return fmt.Errorf("dane: certificate %s has expired (NotAfter %s)", cert.Subject, cert.NotAfter)
+		}
+	}
+	return nil
+}
+
+// chainsToIssuer reports whether the certificate chain leaf..issuer
+// (exclusive of issuer) forms a valid issuance chain ending at issuer.
+func chainsToIssuer(chain []*x509.Certificate, issuer *x509.Certificate) bool {
+	cur := issuer
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !certIsIssuerOf(cur, chain[i]) {
+			return false
+		}
+		cur = chain[i]
+	}
+	return true
+}
+
+func certIsIssuerOf(issuer, cert *x509.Certificate) bool {
+	return cert.CheckSignatureFrom(issuer) == nil
+}
+
+// DANEPolicy carries the "is DANE in effect, and if so does this
+// handshake satisfy it" decision from TLSA lookup time through to the
+// point a remote delivery target has actually connected and completed
+// TLS, so the signal is not dropped in between.
+//
+// NOTE: this source tree does not include maddy's outgoing SMTP
+// delivery target (internal/target/remote in the full maddy
+// repository), so there is no connect/handshake loop here to call
+// DANEPolicy.Check from. It is implemented against the real MX/STARTTLS
+// contract described in the request - look up TLSA for "_<port>._tcp.
+// <mx>", and if DANERequired is true, refuse to use the connection
+// unless VerifyDANE passes, full stop, no downgrade to opportunistic or
+// plaintext - so that once that target exists it is a single call
+// rather than a reimplementation of this package's logic.
+type DANEPolicy struct {
+	Resolver *ExtResolver
+}
+
+// Check looks up TLSA records for the delivery target mx:port and, if
+// DANE is in effect for it (DANERequired), verifies state against them.
+// If DANE is not in effect, Check returns nil and the caller is free to
+// fall back to opportunistic STARTTLS or plaintext delivery per its own
+// policy. If DANE is in effect, a non-nil error from Check MUST cause
+// the caller to refuse the connection outright (RFC 7672 Section 3.1.3)
+// rather than retry without STARTTLS or with a different MX.
+func (p *DANEPolicy) Check(ctx context.Context, mx string, port string, state tls.ConnectionState) error {
+	ad, recs, err := p.Resolver.AuthLookupTLSA(ctx, port, "tcp", mx)
+	if err != nil && !IsNotFound(err) {
+		return fmt.Errorf("dane: TLSA lookup for %s: %w", mx, err)
+	}
+
+	if !DANERequired(ad, recs) {
+		return nil
+	}
+
+	return VerifyDANE(state, ad, recs)
+}
+
+// matchCert checks a single certificate against a TLSA record's
+// selector (full cert vs SPKI) and matching type (exact, SHA-256,
+// SHA-512), per RFC 6698 Section 2.1.
+//
+// Per RFC 7672 Section 3.2, name checks against the certificate (e.g.
+// the usual hostname verification) are skipped entirely for usage 3 /
+// selector 1 / matching type 1 or 2 - the association itself *is* the
+// authorization, so that is already implemented simply by this function
+// never looking at rec.Usage or performing hostname verification.
+func matchCert(cert *x509.Certificate, rec TLSA) error {
+	var data []byte
+	switch rec.Selector {
+	case 0:
+		data = cert.Raw
+	case 1:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return fmt.Errorf("dane: unsupported selector: %v", rec.Selector)
+	}
+
+	var digest string
+	switch rec.MatchingType {
+	case 0:
+		digest = fmt.Sprintf("%x", data)
+	case 1:
+		sum := sha256.Sum256(data)
+		digest = fmt.Sprintf("%x", sum)
+	case 2:
+		sum := sha512.Sum512(data)
+		digest = fmt.Sprintf("%x", sum)
+	default:
+		return fmt.Errorf("dane: unsupported matching type: %v", rec.MatchingType)
+	}
+
+	if digest != rec.Certificate {
+		return fmt.Errorf("dane: certificate association does not match")
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package dns
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// genCert creates a self-signed (parent == nil) or issued (parent,
+// parentKey given) ed25519 certificate valid from notBefore up to
+// notAfter, for exercising VerifyDANE's chain/validity logic without a
+// real CA.
+func genCert(t *testing.T, serial int64, notBefore, notAfter time.Time, parent *x509.Certificate, parentKey ed25519.PrivateKey) (*x509.Certificate, ed25519.PrivateKey) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("test-cert-%d", serial)},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	signerCert, signerKey := tmpl, priv
+	if parent != nil {
+		signerCert, signerKey = parent, parentKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signerCert, pub, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, priv
+}
+
+func tlsaFor(cert *x509.Certificate, usage, selector, matchingType uint8) TLSA {
+	var data []byte
+	switch selector {
+	case 0:
+		data = cert.Raw
+	case 1:
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	sum := sha256.Sum256(data)
+	return TLSA{Usage: usage, Selector: selector, MatchingType: matchingType, Certificate: fmt.Sprintf("%x", sum)}
+}
+
+func TestVerifyDANE_EE(t *testing.T) {
+	now := time.Now()
+
+	valid, _ := genCert(t, 1, now.Add(-time.Hour), now.Add(time.Hour), nil, nil)
+	expired, _ := genCert(t, 2, now.Add(-2*time.Hour), now.Add(-time.Hour), nil, nil)
+	notYetValid, _ := genCert(t, 3, now.Add(time.Hour), now.Add(2*time.Hour), nil, nil)
+
+	cases := []struct {
+		name    string
+		leaf    *x509.Certificate
+		wantErr bool
+	}{
+		{"valid leaf matches", valid, false},
+		{"expired leaf rejected despite matching", expired, true},
+		{"not-yet-valid leaf rejected despite matching", notYetValid, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rec := tlsaFor(c.leaf, 3, 0, 1)
+			state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{c.leaf}}
+			err := VerifyDANE(state, true, []TLSA{rec})
+			if (err != nil) != c.wantErr {
+				t.Fatalf("VerifyDANE() error = %v, wantErr %v", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyDANE_TA(t *testing.T) {
+	now := time.Now()
+
+	validIntermediate, intermediateKey := genCert(t, 10, now.Add(-time.Hour), now.Add(time.Hour), nil, nil)
+	validLeaf, _ := genCert(t, 11, now.Add(-time.Hour), now.Add(time.Hour), validIntermediate, intermediateKey)
+
+	expiredIntermediate, expiredIntermediateKey := genCert(t, 20, now.Add(-2*time.Hour), now.Add(-time.Hour), nil, nil)
+	leafUnderExpiredIntermediate, _ := genCert(t, 21, now.Add(-time.Hour), now.Add(time.Hour), expiredIntermediate, expiredIntermediateKey)
+
+	selfSigned, _ := genCert(t, 30, now.Add(-time.Hour), now.Add(time.Hour), nil, nil)
+
+	cases := []struct {
+		name    string
+		chain   []*x509.Certificate
+		ta      *x509.Certificate
+		wantErr bool
+	}{
+		{"valid 2-hop chain", []*x509.Certificate{validLeaf, validIntermediate}, validIntermediate, false},
+		{"expired intermediate rejected", []*x509.Certificate{leafUnderExpiredIntermediate, expiredIntermediate}, expiredIntermediate, true},
+		{"self-signed leaf as its own trust anchor", []*x509.Certificate{selfSigned}, selfSigned, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rec := tlsaFor(c.ta, 2, 0, 1)
+			state := tls.ConnectionState{PeerCertificates: c.chain}
+			err := VerifyDANE(state, true, []TLSA{rec})
+			if (err != nil) != c.wantErr {
+				t.Fatalf("VerifyDANE() error = %v, wantErr %v", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyDANE_ADRequired(t *testing.T) {
+	now := time.Now()
+	leaf, _ := genCert(t, 40, now.Add(-time.Hour), now.Add(time.Hour), nil, nil)
+	rec := tlsaFor(leaf, 3, 0, 1)
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+
+	if err := VerifyDANE(state, false, []TLSA{rec}); err == nil {
+		t.Fatal("VerifyDANE with ad=false should refuse to use unauthenticated TLSA records")
+	}
+}
+
+func TestMatchCert(t *testing.T) {
+	now := time.Now()
+	cert, _ := genCert(t, 50, now.Add(-time.Hour), now.Add(time.Hour), nil, nil)
+
+	rawDigest := fmt.Sprintf("%x", cert.Raw)
+	sha256Digest := fmt.Sprintf("%x", sha256.Sum256(cert.Raw))
+	spkiSha256Digest := fmt.Sprintf("%x", sha256.Sum256(cert.RawSubjectPublicKeyInfo))
+
+	cases := []struct {
+		name    string
+		rec     TLSA
+		wantErr bool
+	}{
+		{"selector 0 matching type 0 exact match", TLSA{Selector: 0, MatchingType: 0, Certificate: rawDigest}, false},
+		{"selector 0 matching type 1 sha256 match", TLSA{Selector: 0, MatchingType: 1, Certificate: sha256Digest}, false},
+		{"selector 1 matching type 1 spki sha256 match", TLSA{Selector: 1, MatchingType: 1, Certificate: spkiSha256Digest}, false},
+		{"mismatched digest", TLSA{Selector: 0, MatchingType: 1, Certificate: "deadbeef"}, true},
+		{"unsupported selector", TLSA{Selector: 9, MatchingType: 1, Certificate: sha256Digest}, true},
+		{"unsupported matching type", TLSA{Selector: 0, MatchingType: 9, Certificate: sha256Digest}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := matchCert(cert, c.rec)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("matchCert() error = %v, wantErr %v", err, c.wantErr)
+			}
+		})
+	}
+}
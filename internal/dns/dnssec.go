@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/foxcpp/maddy/internal/config"
 	"github.com/miekg/dns"
 )
 
@@ -16,8 +17,8 @@ type TLSA = dns.TLSA
 // access to certain low-level functionality (notably, AD flag in responses,
 // indicating whether DNSSEC verification was performed by the server).
 type ExtResolver struct {
-	cl  *dns.Client
-	Cfg *dns.ClientConfig
+	upstreams []Upstream
+	Cfg       *dns.ClientConfig
 }
 
 // RCodeError is returned by ExtResolver when the RCODE in response is not
@@ -25,6 +26,9 @@ type ExtResolver struct {
 type RCodeError struct {
 	Name string
 	Code int
+	// EDEs holds any Extended DNS Errors (RFC 8914) attached to the
+	// response, if the server sent one alongside the RCODE.
+	EDEs []EDEInfo
 }
 
 func (err RCodeError) Temporary() bool {
@@ -32,19 +36,25 @@ func (err RCodeError) Temporary() bool {
 }
 
 func (err RCodeError) Error() string {
+	var msg string
 	switch err.Code {
 	case dns.RcodeFormatError:
-		return "dns: rcode FORMERR when looking up " + err.Name
+		msg = "dns: rcode FORMERR when looking up " + err.Name
 	case dns.RcodeServerFailure:
-		return "dns: rcode SERVFAIL when looking up " + err.Name
+		msg = "dns: rcode SERVFAIL when looking up " + err.Name
 	case dns.RcodeNameError:
-		return "dns: rcode NXDOMAIN when looking up " + err.Name
+		msg = "dns: rcode NXDOMAIN when looking up " + err.Name
 	case dns.RcodeNotImplemented:
-		return "dns: rcode NOTIMP when looking up " + err.Name
+		msg = "dns: rcode NOTIMP when looking up " + err.Name
 	case dns.RcodeRefused:
-		return "dns: rcode REFUSED when looking up " + err.Name
+		msg = "dns: rcode REFUSED when looking up " + err.Name
+	default:
+		msg = "dns: non-success rcode: " + strconv.Itoa(err.Code) + " when looking up " + err.Name
 	}
-	return "dns: non-success rcode: " + strconv.Itoa(err.Code) + " when looking up " + err.Name
+	if len(err.EDEs) > 0 && err.EDEs[0].Purpose != "" {
+		msg += " (" + err.EDEs[0].Purpose + ")"
+	}
+	return msg
 }
 
 func IsNotFound(err error) bool {
@@ -65,33 +75,74 @@ func isLoopback(addr string) bool {
 	return ip.IsLoopback()
 }
 
-func (e ExtResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+// exchanger is the common interface implemented by ExtResolver and
+// CachingResolver, letting the AuthLookup* logic below be shared between
+// the two instead of duplicated.
+type exchanger interface {
+	exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+}
+
+func (e *ExtResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
 	var resp *dns.Msg
 	var lastErr error
-	for _, srv := range e.Cfg.Servers {
-		resp, _, lastErr = e.cl.ExchangeContext(ctx, msg, net.JoinHostPort(srv, e.Cfg.Port))
+	for _, up := range e.upstreams {
+		resp, lastErr = up.Exchange(ctx, msg)
 		if lastErr != nil {
 			continue
 		}
 
 		if resp.Rcode != dns.RcodeSuccess {
-			lastErr = RCodeError{msg.Question[0].Name, resp.Rcode}
+			lastErr = RCodeError{msg.Question[0].Name, resp.Rcode, extractEDE(resp)}
 			continue
 		}
 
-		// Diregard AD flags from non-local resolvers, likely they are
-		// communicated with using an insecure channel and so flags can be
-		// tampered with.
-		if !isLoopback(srv) {
+		// Disregard AD flags from upstreams that are neither on loopback
+		// nor reached over an authenticated channel (DoT/DoH) - likely
+		// they are communicated with using an insecure channel and so
+		// flags can be tampered with.
+		if !up.Trusted() && !isLoopback(up.Host()) {
 			resp.AuthenticatedData = false
 		}
 
+		if edes := extractEDE(resp); anyBogus(edes) {
+			lastErr = EDEError{msg.Question[0].Name, edes}
+		}
+
 		break
 	}
 	return resp, lastErr
 }
 
-func (e ExtResolver) AuthLookupAddr(ctx context.Context, addr string) (ad bool, names []string, err error) {
+func (e *ExtResolver) AuthLookupAddr(ctx context.Context, addr string) (ad bool, names []string, err error) {
+	return authLookupAddr(ctx, e, addr)
+}
+
+func (e *ExtResolver) AuthLookupHost(ctx context.Context, host string) (ad bool, addrs []string, err error) {
+	return authLookupHost(ctx, e, host)
+}
+
+func (e *ExtResolver) AuthLookupMX(ctx context.Context, name string) (ad bool, mxs []*net.MX, err error) {
+	return authLookupMX(ctx, e, name)
+}
+
+func (e *ExtResolver) AuthLookupTXT(ctx context.Context, name string) (ad bool, recs []string, err error) {
+	return authLookupTXT(ctx, e, name)
+}
+
+func (e *ExtResolver) AuthLookupIPAddr(ctx context.Context, host string) (ad bool, addrs []net.IPAddr, err error) {
+	return authLookupIPAddr(ctx, e, host)
+}
+
+func (e *ExtResolver) AuthLookupTLSA(ctx context.Context, service, network, domain string) (ad bool, recs []TLSA, err error) {
+	return authLookupTLSA(ctx, e, service, network, domain)
+}
+
+// The authLookup* functions implement the actual AuthLookup* logic in
+// terms of the exchanger interface, so both ExtResolver and
+// CachingResolver can share it instead of each reimplementing RR
+// unpacking.
+
+func authLookupAddr(ctx context.Context, r exchanger, addr string) (ad bool, names []string, err error) {
 	revAddr, err := dns.ReverseAddr(addr)
 	if err != nil {
 		return false, nil, err
@@ -102,7 +153,7 @@ func (e ExtResolver) AuthLookupAddr(ctx context.Context, addr string) (ad bool,
 	msg.SetEdns0(4096, false)
 	msg.AuthenticatedData = true
 
-	resp, err := e.exchange(ctx, msg)
+	resp, err := r.exchange(ctx, msg)
 	if err != nil {
 		return false, nil, err
 	}
@@ -120,8 +171,8 @@ func (e ExtResolver) AuthLookupAddr(ctx context.Context, addr string) (ad bool,
 	return
 }
 
-func (e ExtResolver) AuthLookupHost(ctx context.Context, host string) (ad bool, addrs []string, err error) {
-	ad, addrParsed, err := e.AuthLookupIPAddr(ctx, host)
+func authLookupHost(ctx context.Context, r exchanger, host string) (ad bool, addrs []string, err error) {
+	ad, addrParsed, err := authLookupIPAddr(ctx, r, host)
 	if err != nil {
 		return false, nil, err
 	}
@@ -133,13 +184,13 @@ func (e ExtResolver) AuthLookupHost(ctx context.Context, host string) (ad bool,
 	return ad, addrs, nil
 }
 
-func (e ExtResolver) AuthLookupMX(ctx context.Context, name string) (ad bool, mxs []*net.MX, err error) {
+func authLookupMX(ctx context.Context, r exchanger, name string) (ad bool, mxs []*net.MX, err error) {
 	msg := new(dns.Msg)
 	msg.SetQuestion(dns.Fqdn(name), dns.TypeMX)
 	msg.SetEdns0(4096, false)
 	msg.AuthenticatedData = true
 
-	resp, err := e.exchange(ctx, msg)
+	resp, err := r.exchange(ctx, msg)
 	if err != nil {
 		return false, nil, err
 	}
@@ -160,13 +211,13 @@ func (e ExtResolver) AuthLookupMX(ctx context.Context, name string) (ad bool, mx
 	return
 }
 
-func (e ExtResolver) AuthLookupTXT(ctx context.Context, name string) (ad bool, recs []string, err error) {
+func authLookupTXT(ctx context.Context, r exchanger, name string) (ad bool, recs []string, err error) {
 	msg := new(dns.Msg)
 	msg.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
 	msg.SetEdns0(4096, false)
 	msg.AuthenticatedData = true
 
-	resp, err := e.exchange(ctx, msg)
+	resp, err := r.exchange(ctx, msg)
 	if err != nil {
 		return false, nil, err
 	}
@@ -184,14 +235,14 @@ func (e ExtResolver) AuthLookupTXT(ctx context.Context, name string) (ad bool, r
 	return
 }
 
-func (e ExtResolver) AuthLookupIPAddr(ctx context.Context, host string) (ad bool, addrs []net.IPAddr, err error) {
+func authLookupIPAddr(ctx context.Context, r exchanger, host string) (ad bool, addrs []net.IPAddr, err error) {
 	// First, query IPv6.
 	msg := new(dns.Msg)
 	msg.SetQuestion(dns.Fqdn(host), dns.TypeAAAA)
 	msg.SetEdns0(4096, false)
 	msg.AuthenticatedData = true
 
-	resp, err := e.exchange(ctx, msg)
+	resp, err := r.exchange(ctx, msg)
 	if err != nil {
 		return false, nil, err
 	}
@@ -212,7 +263,7 @@ func (e ExtResolver) AuthLookupIPAddr(ctx context.Context, host string) (ad bool
 	msg.SetEdns0(4096, false)
 	msg.AuthenticatedData = true
 
-	resp, err = e.exchange(ctx, msg)
+	resp, err = r.exchange(ctx, msg)
 	if err != nil {
 		return false, nil, err
 	}
@@ -231,7 +282,7 @@ func (e ExtResolver) AuthLookupIPAddr(ctx context.Context, host string) (ad bool
 	return ad, addrs, err
 }
 
-func (e ExtResolver) AuthLookupTLSA(ctx context.Context, service, network, domain string) (ad bool, recs []TLSA, err error) {
+func authLookupTLSA(ctx context.Context, r exchanger, service, network, domain string) (ad bool, recs []TLSA, err error) {
 	name, err := dns.TLSAName(domain, service, network)
 	if err != nil {
 		return false, nil, err
@@ -242,7 +293,7 @@ func (e ExtResolver) AuthLookupTLSA(ctx context.Context, service, network, domai
 	msg.SetEdns0(4096, false)
 	msg.AuthenticatedData = true
 
-	resp, err := e.exchange(ctx, msg)
+	resp, err := r.exchange(ctx, msg)
 	if err != nil {
 		return false, nil, err
 	}
@@ -275,12 +326,79 @@ func NewExtResolver() (*ExtResolver, error) {
 		cfg.Port = port
 	}
 
-	cl := new(dns.Client)
-	cl.Dialer = &net.Dialer{
-		Timeout: time.Duration(cfg.Timeout) * time.Second,
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	upstreams := make([]Upstream, 0, len(cfg.Servers))
+	for _, srv := range cfg.Servers {
+		upstreams = append(upstreams, newPlainUpstream(net.JoinHostPort(srv, cfg.Port), "", timeout))
 	}
+
 	return &ExtResolver{
-		cl:  cl,
-		Cfg: cfg,
+		upstreams: upstreams,
+		Cfg:       cfg,
 	}, nil
 }
+
+// NewExtResolverUpstreams builds an ExtResolver that talks to an explicit
+// list of upstreams instead of the ones configured in /etc/resolv.conf.
+// Each entry is parsed with ParseUpstream, so it may be a bare
+// "host:port", or a "tls://", "https://" or "sdns://" URL for an
+// encrypted transport.
+func NewExtResolverUpstreams(upstreamURLs []string, timeout time.Duration) (*ExtResolver, error) {
+	upstreams := make([]Upstream, 0, len(upstreamURLs))
+	for _, raw := range upstreamURLs {
+		up, err := ParseUpstream(raw, timeout)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, up)
+	}
+
+	return &ExtResolver{
+		upstreams: upstreams,
+		Cfg:       &dns.ClientConfig{Timeout: int(timeout / time.Second)},
+	}, nil
+}
+
+// NewExtResolverFromConfig builds an ExtResolver from a "dns" config
+// block:
+//
+//	dns {
+//	    upstreams tls://1.1.1.1 https://dns.google/dns-query
+//	    bootstrap_dns 9.9.9.9
+//	    timeout 10
+//	}
+//
+// upstreams is a list of upstream URLs as accepted by ParseUpstream. If
+// it is empty, the /etc/resolv.conf-derived default from NewExtResolver
+// is used instead. bootstrap_dns is an optional list of bare nameserver
+// addresses, the first of which is used to resolve any hostname
+// appearing in an upstreams entry
+// (e.g. a DoH/DoT server name) to a literal IP before that upstream is
+// constructed - ParseUpstream itself assumes this has already happened.
+func NewExtResolverFromConfig(cfg *config.Map) (*ExtResolver, error) {
+	var (
+		upstreamURLs   []string
+		bootstrapAddrs []string
+		timeoutSecs    int
+	)
+
+	cfg.StringList("upstreams", false, false, nil, &upstreamURLs)
+	cfg.StringList("bootstrap_dns", false, false, nil, &bootstrapAddrs)
+	cfg.Int("timeout", false, false, 10, &timeoutSecs)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	if len(upstreamURLs) == 0 {
+		return NewExtResolver()
+	}
+
+	timeout := time.Duration(timeoutSecs) * time.Second
+
+	resolved, err := bootstrapUpstreamHosts(upstreamURLs, bootstrapAddrs, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewExtResolverUpstreams(resolved, timeout)
+}
@@ -0,0 +1,127 @@
+package dns
+
+import "github.com/miekg/dns"
+
+// EDEInfo carries one Extended DNS Error (RFC 8914) option as found in a
+// response's OPT record.
+type EDEInfo struct {
+	// InfoCode is the EDE INFO-CODE, see the IANA "Extended DNS Error
+	// Codes" registry.
+	InfoCode uint16
+	// Purpose is a short human-readable description of InfoCode, taken
+	// from RFC 8914, or "" if InfoCode is not recognized.
+	Purpose string
+	// ExtraText is the (possibly server-specific) EXTRA-TEXT string, if
+	// any was sent.
+	ExtraText string
+}
+
+// ednsErrorPurpose maps well-known RFC 8914 INFO-CODEs to their short
+// description. Codes not in this table are left with an empty Purpose.
+var ednsErrorPurpose = map[uint16]string{
+	0:  "Other Error",
+	1:  "Unsupported DNSKEY Algorithm",
+	2:  "Unsupported DS Digest Type",
+	3:  "Stale Answer",
+	4:  "Forged Answer",
+	5:  "DNSSEC Indeterminate",
+	6:  "DNSSEC Bogus",
+	7:  "Signature Expired",
+	8:  "Signature Not Yet Valid",
+	9:  "DNSKEY Missing",
+	10: "RRSIGs Missing",
+	11: "No Zone Key Bit Set",
+	12: "NSEC Missing",
+	13: "Cached Error",
+	14: "Not Ready",
+	15: "Blocked",
+	16: "Censored",
+	17: "Filtered",
+	18: "Prohibited",
+	19: "Stale NXDOMAIN Answer",
+	20: "Not Authoritative",
+	21: "Not Supported",
+	22: "No Reachable Authority",
+	23: "Network Error",
+	24: "Invalid Data",
+}
+
+// bogusEDECodes are the INFO-CODEs that indicate the answer failed DNSSEC
+// validation, as opposed to e.g. a transient network problem. Fail-open
+// behavior (treating a lookup error as "no DNSSEC available") is not safe
+// for these.
+var bogusEDECodes = map[uint16]bool{
+	5:  true, // DNSSEC Indeterminate
+	6:  true, // DNSSEC Bogus
+	7:  true, // Signature Expired
+	8:  true, // Signature Not Yet Valid
+	9:  true, // DNSKEY Missing
+	10: true, // RRSIGs Missing
+	11: true, // No Zone Key Bit Set
+	12: true, // NSEC Missing
+}
+
+func extractEDE(resp *dns.Msg) []EDEInfo {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	var edes []EDEInfo
+	for _, o := range opt.Option {
+		ede, ok := o.(*dns.EDNS0_EDE)
+		if !ok {
+			continue
+		}
+		edes = append(edes, EDEInfo{
+			InfoCode:  ede.InfoCode,
+			Purpose:   ednsErrorPurpose[ede.InfoCode],
+			ExtraText: ede.ExtraText,
+		})
+	}
+	return edes
+}
+
+func anyBogus(edes []EDEInfo) bool {
+	for _, ede := range edes {
+		if bogusEDECodes[ede.InfoCode] {
+			return true
+		}
+	}
+	return false
+}
+
+// EDEError is returned by ExtResolver when an otherwise-successful
+// (NOERROR) response carries an Extended DNS Error (RFC 8914) indicating
+// that the answer is the result of a failed DNSSEC validation. Unlike
+// RCodeError, the message itself was not rejected by the resolver - it is
+// the DNSSEC proof for it that is unusable.
+type EDEError struct {
+	Name string
+	EDEs []EDEInfo
+}
+
+func (err EDEError) Error() string {
+	msg := "dns: DNSSEC validation failure when looking up " + err.Name
+	if len(err.EDEs) > 0 && err.EDEs[0].Purpose != "" {
+		msg += ": " + err.EDEs[0].Purpose
+	}
+	return msg
+}
+
+// IsBogus reports whether err (or, for RCodeError, the EDE attached to
+// it) indicates that an answer was rejected due to failed DNSSEC
+// validation rather than e.g. a transient network or server error. This
+// lets callers that otherwise fail-open on lookup errors refuse to do so
+// when the failure is a validation failure and not, say, a reachability
+// problem.
+func IsBogus(err error) bool {
+	switch e := err.(type) {
+	case EDEError:
+		return anyBogus(e.EDEs)
+	case RCodeError:
+		return anyBogus(e.EDEs)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,485 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream is a DNS transport that can exchange a single query for a
+// response. It abstracts over plain UDP/TCP, DNS-over-TLS and
+// DNS-over-HTTPS so ExtResolver.exchange does not need to know which one
+// it is talking to.
+type Upstream interface {
+	// Exchange sends msg and returns the parsed response.
+	Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+
+	// Trusted indicates whether the channel to this upstream is assumed
+	// to be authenticated (e.g. TLS-protected), meaning the AD bit in
+	// its responses can be relied upon even though the upstream is not
+	// on loopback.
+	Trusted() bool
+
+	// Host returns the bare IP/host the upstream talks to, used to check
+	// whether an untrusted upstream is at least on loopback. Upstreams
+	// that are always Trusted() may return an empty string.
+	Host() string
+
+	String() string
+}
+
+// plainUpstream is the original un-encrypted UDP/TCP transport, used for
+// addresses taken from /etc/resolv.conf or bare host:port upstream URLs.
+type plainUpstream struct {
+	cl   *dns.Client
+	host string
+	addr string
+
+	// mu guards serverCookie, the EDNS0 COOKIE server cookie (RFC 7873)
+	// last seen from addr, echoed back on subsequent queries to mitigate
+	// off-path response spoofing. It is scoped to this single upstream,
+	// since a cookie learned from one nameserver is meaningless to
+	// another.
+	mu           sync.Mutex
+	serverCookie []byte
+}
+
+func newPlainUpstream(addr, network string, timeout time.Duration) *plainUpstream {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return &plainUpstream{
+		cl:   &dns.Client{Net: network, Timeout: timeout},
+		host: host,
+		addr: addr,
+	}
+}
+
+// Exchange sends msg, augmented with this upstream's own EDNS0 COOKIE
+// state. ExtResolver.exchange retries the same *dns.Msg against other
+// upstreams on failure, so msg is cloned before its OPT record is
+// touched - otherwise a cookie attached for this upstream would still be
+// attached (and a second one appended on top of it) when the caller
+// retries the original msg elsewhere.
+func (u *plainUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if msg.IsEdns0() != nil {
+		msg = msg.Copy()
+		u.attachCookie(msg)
+	}
+
+	resp, _, err := u.cl.ExchangeContext(ctx, msg, u.addr)
+	if resp != nil {
+		u.rememberCookie(resp)
+	}
+	return resp, err
+}
+
+// attachCookie adds an EDNS0 COOKIE option to msg, including the server
+// cookie remembered from this upstream's last response, if any. msg must
+// already have been cloned by the caller if it is shared.
+func (u *plainUpstream) attachCookie(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+
+	clientCookie := make([]byte, 8)
+	_, _ = rand.Read(clientCookie)
+
+	u.mu.Lock()
+	serverCookie := u.serverCookie
+	u.mu.Unlock()
+
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(clientCookie) + hex.EncodeToString(serverCookie),
+	})
+}
+
+// rememberCookie persists the server cookie (if any) seen in resp so
+// future queries to this same upstream can present it back.
+func (u *plainUpstream) rememberCookie(resp *dns.Msg) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+	for _, o := range opt.Option {
+		cookie, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok || len(cookie.Cookie) <= 16 {
+			continue
+		}
+		serverCookie, err := hex.DecodeString(cookie.Cookie[16:])
+		if err != nil {
+			continue
+		}
+		u.mu.Lock()
+		u.serverCookie = serverCookie
+		u.mu.Unlock()
+		return
+	}
+}
+
+func (u *plainUpstream) Trusted() bool {
+	return false
+}
+
+func (u *plainUpstream) Host() string {
+	return u.host
+}
+
+func (u *plainUpstream) String() string {
+	return u.addr
+}
+
+// dotUpstream implements DNS-over-TLS (RFC 7858). The channel is
+// authenticated by the TLS handshake, so responses from it are always
+// trusted regardless of the peer address.
+type dotUpstream struct {
+	cl   *dns.Client
+	addr string
+}
+
+func newDoTUpstream(addr, serverName string, timeout time.Duration) *dotUpstream {
+	return &dotUpstream{
+		cl: &dns.Client{
+			Net: "tcp-tls",
+			TLSConfig: &tls.Config{
+				ServerName: serverName,
+			},
+			Timeout: timeout,
+		},
+		addr: addr,
+	}
+}
+
+func (u *dotUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := u.cl.ExchangeContext(ctx, msg, u.addr)
+	return resp, err
+}
+
+func (u *dotUpstream) Trusted() bool {
+	return true
+}
+
+func (u *dotUpstream) Host() string {
+	return ""
+}
+
+func (u *dotUpstream) String() string {
+	return "tls://" + u.addr
+}
+
+// dohUpstream implements DNS-over-HTTPS (RFC 8484), POST'ing the wire
+// format message with the application/dns-message content type. The
+// underlying http.Client pools and reuses connections.
+type dohUpstream struct {
+	cl       *http.Client
+	template string
+}
+
+func newDoHUpstream(template string, timeout time.Duration) *dohUpstream {
+	return &dohUpstream{
+		cl: &http.Client{
+			Timeout: timeout,
+		},
+		template: template,
+	}
+}
+
+const dnsMessageMIME = "application/dns-message"
+
+func (u *dohUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	wire, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.template, bytes.NewReader(wire))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageMIME)
+	req.Header.Set("Accept", dnsMessageMIME)
+
+	respHTTP, err := u.cl.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer respHTTP.Body.Close()
+
+	if respHTTP.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns: DoH upstream %s returned status %v", u.template, respHTTP.Status)
+	}
+
+	body, err := ioutil.ReadAll(respHTTP.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, fmt.Errorf("dns: malformed DoH response from %s: %w", u.template, err)
+	}
+	return resp, nil
+}
+
+func (u *dohUpstream) Trusted() bool {
+	return true
+}
+
+func (u *dohUpstream) Host() string {
+	return ""
+}
+
+func (u *dohUpstream) String() string {
+	return u.template
+}
+
+// ParseUpstream builds an Upstream from a URL as accepted in the
+// "upstreams" directive: a bare "host:port" (plain UDP/TCP, same
+// semantics as a resolv.conf nameserver line), "tls://host:port" for
+// DoT, "https://host/path" for DoH or "sdns://..." for a DNS Stamp
+// encoding either of the former two (see AdGuardTeam/dnsproxy stamps).
+//
+// timeout is used for the upstream's own client; it has no relation to
+// the bootstrap resolver used to resolve the upstream's hostname, if
+// any - callers are expected to have already turned any hostname in
+// rawurl into a literal IP, e.g. via bootstrapUpstreamHosts for
+// upstreams configured through NewExtResolverFromConfig.
+func ParseUpstream(rawurl string, timeout time.Duration) (Upstream, error) {
+	if strings.HasPrefix(rawurl, "sdns://") {
+		return parseDNSStamp(rawurl, timeout)
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme == "" || !strings.Contains(rawurl, "://") {
+		// Not a URL at all - treat as a bare nameserver address, as in
+		// resolv.conf.
+		return newPlainUpstream(rawurl, "", timeout), nil
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		return newPlainUpstream(u.Host, u.Scheme, timeout), nil
+	case "tls":
+		host, _, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			host = u.Host
+		}
+		return newDoTUpstream(withDefaultPort(u.Host, "853"), host, timeout), nil
+	case "https":
+		return newDoHUpstream(u.String(), timeout), nil
+	default:
+		return nil, fmt.Errorf("dns: unsupported upstream scheme: %v", u.Scheme)
+	}
+}
+
+func withDefaultPort(hostport, port string) string {
+	if _, _, err := net.SplitHostPort(hostport); err == nil {
+		return hostport
+	}
+	return net.JoinHostPort(hostport, port)
+}
+
+// bootstrapUpstreamHosts rewrites any hostname found in each of rawurls
+// to a literal IP, resolved using bootstrapAddrs rather than the system
+// resolver - the usual way to avoid a circular dependency between a
+// DoH/DoT upstream and the resolver needed to reach it in the first
+// place. Only the first address in bootstrapAddrs is queried. If
+// bootstrapAddrs is empty, rawurls is returned unchanged, and any
+// hostname left in them is resolved by the system resolver when the
+// upstream dials it.
+func bootstrapUpstreamHosts(rawurls, bootstrapAddrs []string, timeout time.Duration) ([]string, error) {
+	if len(bootstrapAddrs) == 0 {
+		return rawurls, nil
+	}
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: timeout}
+			return d.DialContext(ctx, network, net.JoinHostPort(bootstrapAddrs[0], "53"))
+		},
+	}
+
+	out := make([]string, len(rawurls))
+	for i, raw := range rawurls {
+		resolved, err := bootstrapOne(resolver, raw, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("dns: bootstrap resolution of %q: %w", raw, err)
+		}
+		out[i] = resolved
+	}
+	return out, nil
+}
+
+// bootstrapOne resolves the hostname in a single upstream URL, if any.
+// A "sdns://" DNS Stamp already embeds a literal address and is
+// returned unchanged.
+func bootstrapOne(resolver *net.Resolver, rawurl string, timeout time.Duration) (string, error) {
+	if strings.HasPrefix(rawurl, "sdns://") {
+		return rawurl, nil
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme == "" || !strings.Contains(rawurl, "://") {
+		return bootstrapHostPort(resolver, rawurl, timeout)
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+		host, err := bootstrapHostPort(resolver, u.Host, timeout)
+		if err != nil {
+			return "", err
+		}
+		u.Host = host
+		return u.String(), nil
+	case "https":
+		host := u.Hostname()
+		if net.ParseIP(host) != nil {
+			return rawurl, nil
+		}
+		ip, err := bootstrapLookup(resolver, host, timeout)
+		if err != nil {
+			return "", err
+		}
+		if port := u.Port(); port != "" {
+			u.Host = net.JoinHostPort(ip, port)
+		} else {
+			u.Host = ip
+		}
+		return u.String(), nil
+	default:
+		return rawurl, nil
+	}
+}
+
+// bootstrapHostPort resolves the host part of a "host:port" or bare host
+// string, preserving the port (if any).
+func bootstrapHostPort(resolver *net.Resolver, hostport string, timeout time.Duration) (string, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, ""
+	}
+	if net.ParseIP(host) != nil {
+		return hostport, nil
+	}
+
+	ip, err := bootstrapLookup(resolver, host, timeout)
+	if err != nil {
+		return "", err
+	}
+	if port == "" {
+		return ip, nil
+	}
+	return net.JoinHostPort(ip, port), nil
+}
+
+func bootstrapLookup(resolver *net.Resolver, host string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("no addresses found for %s", host)
+	}
+	return ips[0].String(), nil
+}
+
+// DNS Stamp protocol identifiers, see
+// https://dnscrypt.info/stamps-specifications
+const (
+	stampProtoDNSCrypt = 0x01
+	stampProtoDoH      = 0x02
+	stampProtoDoT      = 0x03
+)
+
+// parseDNSStamp decodes a "sdns://" DNS Stamp and constructs the
+// corresponding Upstream. Only the DoH and DoT protocols are supported;
+// plain DNSCrypt stamps are rejected since we have no DNSCrypt client
+// implementation.
+func parseDNSStamp(rawurl string, timeout time.Duration) (Upstream, error) {
+	b64 := strings.TrimPrefix(rawurl, "sdns://")
+	raw, err := base64.RawURLEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("dns: malformed DNS stamp: %w", err)
+	}
+	if len(raw) < 1 {
+		return nil, fmt.Errorf("dns: empty DNS stamp")
+	}
+
+	proto := raw[0]
+	// props (8 bytes) follow the protocol byte, we don't act on them.
+	rest := raw[1:]
+	if len(rest) < 8 {
+		return nil, fmt.Errorf("dns: truncated DNS stamp")
+	}
+	rest = rest[8:]
+
+	addr, rest, err := readStampLP(rest)
+	if err != nil {
+		return nil, fmt.Errorf("dns: malformed DNS stamp address: %w", err)
+	}
+
+	switch proto {
+	case stampProtoDoT:
+		hashes, rest, err := readStampLP(rest)
+		_ = hashes
+		if err != nil {
+			return nil, fmt.Errorf("dns: malformed DNS stamp: %w", err)
+		}
+		serverName, _, err := readStampLP(rest)
+		if err != nil {
+			return nil, fmt.Errorf("dns: malformed DNS stamp: %w", err)
+		}
+		return newDoTUpstream(withDefaultPort(addr, "853"), serverName, timeout), nil
+	case stampProtoDoH:
+		hashes, rest, err := readStampLP(rest)
+		_ = hashes
+		if err != nil {
+			return nil, fmt.Errorf("dns: malformed DNS stamp: %w", err)
+		}
+		hostname, rest, err := readStampLP(rest)
+		if err != nil {
+			return nil, fmt.Errorf("dns: malformed DNS stamp: %w", err)
+		}
+		path, _, err := readStampLP(rest)
+		if err != nil {
+			return nil, fmt.Errorf("dns: malformed DNS stamp: %w", err)
+		}
+		template := "https://" + hostname + path
+		return newDoHUpstream(template, timeout), nil
+	case stampProtoDNSCrypt:
+		return nil, fmt.Errorf("dns: DNSCrypt upstreams are not supported, use its DoH/DoT stamp instead")
+	default:
+		return nil, fmt.Errorf("dns: unsupported DNS stamp protocol: %v", proto)
+	}
+}
+
+// readStampLP reads a length-prefixed (LP) string as used throughout the
+// DNS Stamp format: a single length byte followed by that many bytes.
+func readStampLP(b []byte) (string, []byte, error) {
+	if len(b) < 1 {
+		return "", nil, fmt.Errorf("unexpected end of stamp")
+	}
+	n := int(b[0])
+	b = b[1:]
+	if len(b) < n {
+		return "", nil, fmt.Errorf("unexpected end of stamp")
+	}
+	return string(b[:n]), b[n:], nil
+}
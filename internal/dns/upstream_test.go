@@ -0,0 +1,47 @@
+package dns
+
+import "testing"
+
+// TestPlainUpstreamHost guards against regressing the loopback-trust
+// check in ExtResolver.exchange to use String() (host:port) instead of
+// Host() (bare host) - isLoopback can only parse the latter.
+func TestPlainUpstreamHost(t *testing.T) {
+	cases := []struct {
+		addr     string
+		wantHost string
+	}{
+		{"127.0.0.53:53", "127.0.0.53"},
+		{"9.9.9.9:53", "9.9.9.9"},
+		{"[::1]:53", "::1"},
+	}
+
+	for _, c := range cases {
+		up := newPlainUpstream(c.addr, "", 0)
+		if up.Host() != c.wantHost {
+			t.Errorf("newPlainUpstream(%q).Host() = %q, want %q", c.addr, up.Host(), c.wantHost)
+		}
+		if up.String() != c.addr {
+			t.Errorf("newPlainUpstream(%q).String() = %q, want %q", c.addr, up.String(), c.addr)
+		}
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	cases := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.53", true},
+		{"::1", true},
+		{"9.9.9.9", false},
+		// A host:port string, as String() returns for plainUpstream, is
+		// not a valid input - isLoopback must be called with Host().
+		{"127.0.0.53:53", false},
+	}
+
+	for _, c := range cases {
+		if got := isLoopback(c.addr); got != c.want {
+			t.Errorf("isLoopback(%q) = %v, want %v", c.addr, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// Package dkim implements the sign_dkim modifier, which adds a
+// DKIM-Signature header to outgoing messages. It is the signing
+// counterpart to the verify_dkim check in internal/check/dkim.
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+var defaultHeaderFields = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "MIME-Version", "Content-Type",
+}
+
+type selectorKey struct {
+	domain   string
+	selector string
+	signer   crypto.Signer
+	keyType  string // "rsa" or "ed25519", mirrors the DKIM k= tag
+}
+
+// Modifier implements the sign_dkim modifier - it loads a single
+// selector key (domain, selector, key_path) from disk and adds a
+// DKIM-Signature header to the outgoing message when the domain of its
+// RFC 5322 From header matches that key's domain. Only one selector is
+// configured per instance, and at most one signature is added per
+// message.
+type Modifier struct {
+	instName string
+	log      log.Logger
+
+	keys []selectorKey
+
+	headerFields       []string
+	oversignFields     []string
+	signSubdomains     bool
+	requireSenderMatch bool
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("sign_dkim: inline arguments are not used")
+	}
+	return &Modifier{
+		instName: instName,
+		log:      log.Logger{Name: "sign_dkim"},
+	}, nil
+}
+
+func (m *Modifier) Init(cfg *config.Map) error {
+	var (
+		domain         string
+		selector       string
+		keyPath        string
+		headerFields   []string
+		oversignFields []string
+	)
+
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.String("domain", false, true, "", &domain)
+	cfg.String("selector", false, true, "", &selector)
+	cfg.String("key_path", false, true, "", &keyPath)
+	cfg.StringList("header_fields", false, false, defaultHeaderFields, &headerFields)
+	cfg.StringList("oversign_fields", false, false, nil, &oversignFields)
+	cfg.Bool("sign_subdomains", false, false, &m.signSubdomains)
+	cfg.Bool("require_sender_match", false, false, &m.requireSenderMatch)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	key, keyType, err := loadSigningKey(keyPath)
+	if err != nil {
+		return fmt.Errorf("sign_dkim: %s: %w", keyPath, err)
+	}
+
+	m.keys = []selectorKey{{
+		domain:   strings.ToLower(domain),
+		selector: selector,
+		signer:   key,
+		keyType:  keyType,
+	}}
+	m.headerFields = headerFields
+	m.oversignFields = oversignFields
+
+	return nil
+}
+
+func (m *Modifier) Name() string {
+	return "sign_dkim"
+}
+
+func (m *Modifier) InstanceName() string {
+	return m.instName
+}
+
+type modState struct {
+	m       *Modifier
+	msgMeta *module.MsgMetadata
+}
+
+func (m *Modifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &modState{m: m, msgMeta: msgMeta}, nil
+}
+
+func (s *modState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s *modState) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+	return rcptTo, nil
+}
+
+func (s *modState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	key, ok := s.m.selectFor(h)
+	if !ok {
+		if s.m.requireSenderMatch {
+			return errors.New("sign_dkim: From header does not match any configured domain")
+		}
+		s.m.log.Debugf("skipping signing, From header does not match any configured domain")
+		return nil
+	}
+
+	headerFields := make([]string, 0, len(s.m.headerFields)+len(s.m.oversignFields))
+	headerFields = append(headerFields, s.m.headerFields...)
+	headerFields = append(headerFields, s.m.oversignFields...)
+
+	opts := &dkim.SignOptions{
+		Domain:                 key.domain,
+		Selector:               key.selector,
+		Signer:                 key.signer,
+		HeaderKeys:             headerFields,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+	}
+
+	b := bytes.Buffer{}
+	if err := textproto.WriteHeader(&b, *h); err != nil {
+		return err
+	}
+	bodyRdr, err := body.Open()
+	if err != nil {
+		return err
+	}
+
+	var signed bytes.Buffer
+	if err := dkim.Sign(&signed, io.MultiReader(&b, bodyRdr), opts); err != nil {
+		return fmt.Errorf("sign_dkim: %w", err)
+	}
+
+	signedHeader, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(signed.Bytes())))
+	if err != nil {
+		return fmt.Errorf("sign_dkim: failed to parse signed header: %w", err)
+	}
+	sigFields := signedHeader.FieldsByKey("DKIM-Signature")
+	if !sigFields.Next() {
+		return errors.New("sign_dkim: dkim.Sign did not produce a signature")
+	}
+	h.Add("DKIM-Signature", sigFields.Value())
+
+	return nil
+}
+
+func (s *modState) Close() error {
+	return nil
+}
+
+// selectFor picks the configured selector key whose domain matches the
+// RFC 5322 From header's address (or one of its parent domains, if
+// sign_subdomains is set).
+//
+// This is deliberately the From header and not the SMTP envelope sender:
+// DKIM's practical purpose is DMARC alignment, and DMARC aligns a
+// passing signature's d= against the visible From header, never against
+// MAIL FROM. Selecting by envelope sender would silently sign with the
+// wrong key - or skip signing outright - on any message where the two
+// differ, which is routine (bounce/VERP envelope senders, mailing list
+// resends).
+func (m *Modifier) selectFor(h *textproto.Header) (selectorKey, bool) {
+	from := h.Get("From")
+	if from == "" {
+		return selectorKey{}, false
+	}
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return selectorKey{}, false
+	}
+
+	_, addrDomain, ok := cutAt(addr.Address)
+	if !ok {
+		return selectorKey{}, false
+	}
+	addrDomain = strings.ToLower(addrDomain)
+
+	for _, key := range m.keys {
+		if addrDomain == key.domain {
+			return key, true
+		}
+		if m.signSubdomains && strings.HasSuffix(addrDomain, "."+key.domain) {
+			return key, true
+		}
+	}
+	return selectorKey{}, false
+}
+
+func cutAt(addr string) (local, domain string, ok bool) {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return "", "", false
+	}
+	return addr[:i], addr[i+1:], true
+}
+
+// loadSigningKey reads a PEM-encoded ed25519 or RSA private key from
+// path and returns it together with the DKIM k= tag value it implies.
+func loadSigningKey(path string) (crypto.Signer, string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, "", errors.New("no PEM block found")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		// Fall back to the legacy PKCS#1 RSA format, which is what
+		// openssl genrsa produces without -traditional / pkcs8.
+		if rsaKey, rsaErr := x509.ParsePKCS1PrivateKey(block.Bytes); rsaErr == nil {
+			return rsaKey, "rsa", nil
+		}
+		return nil, "", err
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, "rsa", nil
+	case ed25519.PrivateKey:
+		return k, "ed25519", nil
+	default:
+		return nil, "", fmt.Errorf("unsupported private key type: %T", key)
+	}
+}
+
+func init() {
+	module.Register("sign_dkim", New)
+}
@@ -0,0 +1,34 @@
+package dkim
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+)
+
+// GenerateEd25519Key creates a new ed25519 DKIM keypair for selector and
+// domain. It returns the PEM-encoded private key, meant to be written to
+// the path configured as key_path, and the exact TXT record value to
+// publish at "<selector>._domainkey.<domain>" so maddyctl users can
+// copy-paste it straight into their zone file.
+func GenerateEd25519Key(selector, domain string) (keyPEM []byte, dnsRecord string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, "", err
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	})
+
+	dnsRecord = fmt.Sprintf("v=DKIM1; k=ed25519; p=%s", base64.StdEncoding.EncodeToString(pub))
+	return keyPEM, dnsRecord, nil
+}